@@ -7,11 +7,14 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"golang.org/x/oauth2"
@@ -23,25 +26,93 @@ import (
 // Version number of the program.
 const Version = "1.0.0"
 
+// defaultDOPageSize is used when Config.DOPageSize isn't set.
+const defaultDOPageSize = 200
+
 // Command line flags.
 var (
 	configure      bool
 	domainOverride string
 	forceUpdate    bool
+	daemon         bool
+)
+
+// Loggers for info (stdout) versus warnings and errors (stderr). Using
+// separate loggers, rather than checking a level on every call, keeps each
+// call site a one-liner and makes it obvious at a glance where output goes.
+var (
+	infoLog    = log.New(os.Stdout, "", log.LstdFlags)
+	warningLog = log.New(os.Stderr, "WARNING: ", log.LstdFlags)
+	errorLog   = log.New(os.Stderr, "ERROR: ", log.LstdFlags)
 )
 
+func logInfo(v ...interface{})                 { infoLog.Println(v...) }
+func logInfof(format string, v ...interface{}) { infoLog.Printf(format, v...) }
+
+func logWarningf(format string, v ...interface{}) { warningLog.Printf(format, v...) }
+
+func logErrorf(format string, v ...interface{}) { errorLog.Printf(format, v...) }
+
 // Config describes the JSON schema for the app's config file.
 type Config struct {
-	AccessToken string      `json:"accessToken"`
-	Domain      string      `json:"domain"`
-	LastIPv4    string      `json:"ipv4,omitempty"`
-	LastIPv6    string      `json:"ipv6,omitempty"`
-	TTL         int         `json:"ttl"`
-	RecordTypes RecordTypes `json:"recordTypes"`
-	LastRun     string      `json:"lastRun"`
+	AccessToken string         `json:"accessToken"`
+	Domains     []DomainConfig `json:"domains,omitempty"`
+	LastIPv4    string         `json:"ipv4,omitempty"`
+	LastIPv6    string         `json:"ipv6,omitempty"`
+	LastRun     string         `json:"lastRun"`
+
+	// Interval is how often to re-check the external IP when running in
+	// -daemon mode, e.g. "5m". Parsed with time.ParseDuration.
+	Interval string `json:"interval,omitempty"`
+
+	// DOPageSize is the page size to request when listing DNS records, for
+	// domains with more records than fit on a single page. Defaults to 200.
+	DOPageSize int `json:"doPageSize,omitempty"`
+
+	// PruneRecords, if true, deletes existing A/AAAA records that aren't
+	// named in a domain's Records list. Off by default, since most users
+	// only want this program to touch the records they've configured.
+	PruneRecords bool `json:"pruneRecords,omitempty"`
+
+	// AllowIPv4InIPv6, if true, allows an IPv4-mapped address (e.g. one
+	// returned by a lookup service that doesn't actually support IPv6) to
+	// be written to a AAAA record. Off by default, so a broken IPv6 lookup
+	// can't silently clobber a real AAAA record.
+	AllowIPv4InIPv6 bool `json:"allowIPv4InIPv6,omitempty"`
+
+	// IPv4CheckURLs and IPv6CheckURLs are the HTTP endpoints tried, in
+	// order, to discover our external IP address. If empty, defaultCheckURLs
+	// is used. Each is expected to respond with the plain-text IP address.
+	IPv4CheckURLs []string `json:"ipv4CheckUrls,omitempty"`
+	IPv6CheckURLs []string `json:"ipv6CheckUrls,omitempty"`
+
+	// Deprecated: the following fields describe the old single-domain
+	// config schema (one domain, @ and * records only). They're only read
+	// by LoadConfig to migrate old config files into Domains; new configs
+	// are written using Domains exclusively.
+	Domain      string      `json:"domain,omitempty"`
+	TTL         int         `json:"ttl,omitempty"`
+	RecordTypes RecordTypes `json:"recordTypes,omitempty"`
+}
+
+// DomainConfig describes a single domain and the records on it that this
+// program should keep pointed at our external IP address.
+type DomainConfig struct {
+	Domain  string       `json:"domain"`
+	Records []RecordSpec `json:"records"`
+}
+
+// RecordSpec identifies one DNS record to manage within a DomainConfig.
+type RecordSpec struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	TTL  int    `json:"ttl"`
 }
 
 // RecordTypes is the config attribute for supporting IPv4 vs. IPv6.
+//
+// Deprecated: used only to migrate the old single-domain config schema;
+// see DomainConfig and RecordSpec.
 type RecordTypes struct {
 	A    bool `json:"A"`
 	AAAA bool `json:"AAAA"`
@@ -55,10 +126,27 @@ func (c *Config) Token() (*oauth2.Token, error) {
 	return token, nil
 }
 
+// wantsRecordTypes reports whether any domain has at least one A or AAAA
+// record configured, so the caller knows which IP families to look up.
+func (c *Config) wantsRecordTypes() (wantA, wantAAAA bool) {
+	for _, domainCfg := range c.Domains {
+		for _, rec := range domainCfg.Records {
+			switch rec.Type {
+			case "A":
+				wantA = true
+			case "AAAA":
+				wantAAAA = true
+			}
+		}
+	}
+	return
+}
+
 func init() {
 	flag.BoolVar(&configure, "config", false, "(Re)configure your Digital Ocean API key.")
-	flag.StringVar(&domainOverride, "domain", "", "Use this domain name instead of the one saved with the config.")
+	flag.StringVar(&domainOverride, "domain", "", "Only update this domain, instead of every domain saved in the config.")
 	flag.BoolVar(&forceUpdate, "force", false, "Force update the DNS even if the IP addresses haven't changed.")
+	flag.BoolVar(&daemon, "daemon", false, "Stay running and re-check the external IP on a timer instead of exiting after one pass.")
 }
 
 func main() {
@@ -70,7 +158,7 @@ func main() {
 	// Load the config file.
 	config, err := LoadConfig()
 	if err != nil {
-		fmt.Printf("Error: %s\n", err)
+		logErrorf("could not load config: %s", err)
 	}
 
 	// If no access token configured, run setup.
@@ -78,55 +166,142 @@ func main() {
 		Setup()
 	}
 
+	if daemon {
+		RunDaemon(config)
+		return
+	}
+
+	CheckAndUpdate(config)
+}
+
+// CheckAndUpdate performs a single check/update pass: it looks up the
+// current external IP address(es), compares them against the last known
+// values in config, updates DigitalOcean DNS if they've changed, and writes
+// the refreshed config back to disk.
+func CheckAndUpdate(config Config) {
 	// Print the last run time.
 	if config.LastRun != "" {
-		fmt.Printf("Last time this program ran was: %s\n", config.LastRun)
+		logInfof("Last time this program ran was: %s", config.LastRun)
 	}
 
-	// Collect our IP address(es).
+	// Collect our IP address(es). A failure to resolve one family is logged
+	// and skipped rather than aborting the run, so a transient IPv6 outage
+	// doesn't also block IPv4 updates.
+	wantA, wantAAAA := config.wantsRecordTypes()
 	var (
 		ipv4    net.IP
 		ipv6    net.IP
 		changed = forceUpdate
 	)
-	if config.RecordTypes.A {
-		ipv4, err = GetExternalIP(4)
+	if wantA {
+		var err error
+		ipv4, err = GetExternalIP(4, config)
 		if err != nil {
-			panic(err)
-		}
-		fmt.Printf("Found my IPv4 address: %s\n", ipv4)
-		if config.LastIPv4 != ipv4.String() {
-			changed = true
+			logErrorf("could not determine our IPv4 address, skipping IPv4 update this round: %s", err)
+		} else {
+			logInfof("Found my IPv4 address: %s", ipv4)
+			if config.LastIPv4 != ipv4.String() {
+				changed = true
+			}
 		}
 	}
-	if config.RecordTypes.AAAA {
-		ipv6, err = GetExternalIP(6)
+	if wantAAAA {
+		var err error
+		ipv6, err = GetExternalIP(6, config)
 		if err != nil {
-			panic(err)
-		}
-		fmt.Printf("Found my IPv6 address: %s\n", ipv6)
-		if config.LastIPv6 != ipv6.String() {
-			changed = true
+			logErrorf("could not determine our IPv6 address, skipping IPv6 update this round: %s", err)
+		} else {
+			logInfof("Found my IPv6 address: %s", ipv6)
+			if config.LastIPv6 != ipv6.String() {
+				changed = true
+			}
 		}
 	}
 
 	// Do the addresses differ from the last seen ones?
 	if changed {
-		fmt.Println("My IP address has changed from when I last checked!")
-		fmt.Println("Updating DO DNS now!")
+		logInfo("My IP address has changed from when I last checked!")
+		logInfo("Updating DO DNS now!")
 		UpdateDNS(config, ipv4, ipv6)
 	} else {
-		fmt.Println("No changes detected in my IP address")
+		logInfo("No changes detected in my IP address")
 	}
 
 	// Update the stored configuration to, at the very least, refresh the
-	// "last run" time.
-	config.LastIPv4 = ipv4.String()
-	config.LastIPv6 = ipv6.String()
+	// "last run" time. Only overwrite the last-seen IP for a family that
+	// actually resolved this round, so a transient lookup failure doesn't
+	// forget the last known-good address.
+	if ipv4 != nil {
+		config.LastIPv4 = ipv4.String()
+	}
+	if ipv6 != nil {
+		config.LastIPv6 = ipv6.String()
+	}
 	WriteConfig(config)
 }
 
-// UpdateDNS uses the Digital Ocean API to update your DNS records.
+// RunDaemon keeps the process alive, re-running CheckAndUpdate on a ticker
+// until it receives SIGINT or SIGTERM. This lets users avoid depending on
+// cron or a systemd timer to keep their DNS up to date.
+func RunDaemon(config Config) {
+	interval := config.Interval
+	if interval == "" {
+		interval = "5m"
+	}
+
+	duration, err := time.ParseDuration(interval)
+	if err != nil {
+		logErrorf("invalid interval %q: %s", interval, err)
+		os.Exit(1)
+	}
+
+	logInfof("Running in daemon mode, checking every %s. Press Ctrl+C to stop.", duration)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		// Run an initial pass immediately rather than waiting for the first tick.
+		safeCheckAndUpdate(config)
+
+		ticker := time.NewTicker(duration)
+		defer ticker.Stop()
+		for range ticker.C {
+			// Reload the config each tick, since CheckAndUpdate persists
+			// the last-seen IPs and run time back to disk after every pass.
+			current, err := LoadConfig()
+			if err != nil {
+				logErrorf("could not reload config, skipping this tick: %s", err)
+				continue
+			}
+			safeCheckAndUpdate(current)
+		}
+	}()
+
+	sig := <-sigCh
+	logInfof("Received %s, shutting down...", sig)
+	current, err := LoadConfig()
+	if err != nil {
+		logErrorf("could not reload config on shutdown: %s", err)
+		return
+	}
+	WriteConfig(current)
+}
+
+// safeCheckAndUpdate runs CheckAndUpdate, recovering from any panic so that
+// one bad tick in daemon mode logs an error and waits for the next tick
+// instead of taking the whole process down.
+func safeCheckAndUpdate(config Config) {
+	defer func() {
+		if r := recover(); r != nil {
+			logErrorf("recovered from panic during check/update: %v", r)
+		}
+	}()
+	CheckAndUpdate(config)
+}
+
+// UpdateDNS uses the Digital Ocean API to update your DNS records across
+// every domain and record configured in config.Domains.
 func UpdateDNS(config Config, ipv4, ipv6 net.IP) {
 	ctx := context.Background()
 
@@ -134,83 +309,334 @@ func UpdateDNS(config Config, ipv4, ipv6 net.IP) {
 	oauthClient := oauth2.NewClient(ctx, &config)
 	client := godo.NewClient(oauthClient)
 
-	// The domain name to look up in DO DNS.
-	domainName := config.Domain
-	if domainOverride != "" {
-		domainName = domainOverride
+	pageSize := config.DOPageSize
+	if pageSize <= 0 {
+		pageSize = defaultDOPageSize
 	}
 
-	// Get the DNS records. TODO: support domains with more than 50 records.
-	records, _, err := client.Domains.Records(ctx, domainName, &godo.ListOptions{
-		PerPage: 50,
-	})
+	for _, domainCfg := range config.Domains {
+		// -domain restricts the run to the configured domain of that name,
+		// rather than renaming every domain onto it; a name that isn't in
+		// config.Domains matches nothing, so no records are updated.
+		if domainOverride != "" && domainCfg.Domain != domainOverride {
+			continue
+		}
+		updateDomain(ctx, client, domainCfg, ipv4, ipv6, pageSize, config.PruneRecords, config.AllowIPv4InIPv6)
+	}
+}
+
+// recordKey identifies a DNS record by the fields DigitalOcean treats as
+// its identity within a domain: type and name. Existing records are matched
+// against configured RecordSpecs by this key.
+func recordKey(recordType, name string) string {
+	return recordType + "|" + name
+}
+
+// updateDomain reconciles the configured records for a single domain
+// against what's actually in DigitalOcean DNS: existing records are edited
+// in place when their data or TTL has changed, missing ones are created,
+// and (only if prune is set) records that aren't in domainCfg.Records are
+// deleted. This avoids the DNS blackout window and extra API calls of
+// deleting and recreating every record on every run, and keeps record IDs
+// stable for other integrations that reference them.
+func updateDomain(ctx context.Context, client *godo.Client, domainCfg DomainConfig, ipv4, ipv6 net.IP, pageSize int, prune, allowIPv4InIPv6 bool) {
+	// The domain name to look up in DO DNS. Filtering by -domain, if any,
+	// already happened in UpdateDNS, so domainCfg is the domain to update.
+	domainName := domainCfg.Domain
+
+	records, err := listAllRecords(ctx, client, domainName, pageSize)
 	if err != nil {
-		fmt.Printf("Could not look up DNS for domain %s: doesn't exist in DO?\n", domainName)
-		fmt.Printf("Error given from API: %s\n", err)
-		os.Exit(1)
+		logErrorf("could not look up DNS records for domain %s, skipping it (does it exist in DO?): %s", domainName, err)
+		return
 	}
 
-	// Find A and AAAA records, and delete them.
+	existing := map[string]godo.DomainRecord{}
 	for _, record := range records {
 		if record.Type == "A" || record.Type == "AAAA" {
-			fmt.Printf("Delete DNS record %s: %s %s\n", record.Type, record.Name, record.Data)
-			_, err = client.Domains.DeleteRecord(ctx, domainName, record.ID)
-			if err != nil {
-				panic(err)
-			}
+			existing[recordKey(record.Type, record.Name)] = record
 		}
 	}
 
-	// Insert new records.
-	for _, recordType := range []string{"A", "AAAA"} {
-		// Skip record types that we're not updating.
-		if (recordType == "A" && !config.RecordTypes.A) || (recordType == "AAAA" && !config.RecordTypes.AAAA) {
-			continue
-		}
-
+	managed := map[string]bool{}
+	for _, rec := range domainCfg.Records {
 		var dnsValue net.IP
-		if recordType == "A" {
+		switch rec.Type {
+		case "A":
 			dnsValue = ipv4
-		} else {
+		case "AAAA":
 			dnsValue = ipv6
+		default:
+			logWarningf("skipping record %s %s on %s: unsupported record type", rec.Type, rec.Name, domainName)
+			continue
 		}
 
-		for _, subdomain := range []string{"@", "*"} {
-			fmt.Printf("Creating %s record: %s %s\n", recordType, subdomain, dnsValue)
-			record := &godo.DomainRecordEditRequest{
-				Type: recordType,
-				Name: subdomain,
-				Data: dnsValue.String(),
-				TTL:  config.TTL,
+		// Mark the record as managed before any skip below, so a record
+		// that's skipped this round (e.g. its IP family didn't resolve) is
+		// never pruned.
+		key := recordKey(rec.Type, rec.Name)
+		managed[key] = true
+
+		if dnsValue == nil {
+			continue
+		}
+
+		// GetExternalIP already filters out IPv4-mapped addresses for
+		// version 6 unless AllowIPv4InIPv6 is set, so this is normally
+		// unreachable; it's kept as defense-in-depth for any future caller
+		// that passes an ipv6 argument to UpdateDNS without going through
+		// GetExternalIP's validation.
+		if rec.Type == "AAAA" && !allowIPv4InIPv6 && dnsValue.To4() != nil {
+			logWarningf("skipping AAAA record %s on %s: %s looks like an IPv4-mapped address", rec.Name, domainName, dnsValue)
+			continue
+		}
+
+		editRequest := &godo.DomainRecordEditRequest{
+			Type: rec.Type,
+			Name: rec.Name,
+			Data: dnsValue.String(),
+			TTL:  rec.TTL,
+		}
+
+		if old, ok := existing[key]; ok {
+			if old.Data == editRequest.Data && old.TTL == editRequest.TTL {
+				logInfof("%s record %s on %s is already up to date", rec.Type, rec.Name, domainName)
+				continue
 			}
 
-			_, _, err = client.Domains.CreateRecord(ctx, domainName, record)
-			if err != nil {
-				panic(err)
+			logInfof("Updating %s record on %s: %s -> %s", rec.Type, domainName, rec.Name, dnsValue)
+			if _, _, err := client.Domains.EditRecord(ctx, domainName, old.ID, editRequest); err != nil {
+				logErrorf("could not update %s record %s on %s: %s", rec.Type, rec.Name, domainName, err)
 			}
+			continue
+		}
+
+		logInfof("Creating %s record on %s: %s %s", rec.Type, domainName, rec.Name, dnsValue)
+		if _, _, err := client.Domains.CreateRecord(ctx, domainName, editRequest); err != nil {
+			logErrorf("could not create %s record %s on %s: %s", rec.Type, rec.Name, domainName, err)
+		}
+	}
+
+	if !prune {
+		return
+	}
+
+	for key, record := range existing {
+		if managed[key] {
+			continue
+		}
+
+		logInfof("Pruning unmanaged %s record on %s: %s %s", record.Type, domainName, record.Name, record.Data)
+		if _, err := client.Domains.DeleteRecord(ctx, domainName, record.ID); err != nil {
+			logErrorf("could not delete %s record %s on %s: %s", record.Type, record.Name, domainName, err)
 		}
 	}
 }
 
-// GetExternalIP gets an external IP address.
-func GetExternalIP(version int) (result net.IP, err error) {
-	url := fmt.Sprintf("https://ipv%d.myexternalip.com/raw", version)
+// listAllRecords returns every DNS record for a domain, walking every page
+// of results so domains with more records than fit on one page aren't
+// silently truncated.
+func listAllRecords(ctx context.Context, client *godo.Client, domainName string, pageSize int) ([]godo.DomainRecord, error) {
+	var (
+		all = []godo.DomainRecord{}
+		opt = &godo.ListOptions{Page: 1, PerPage: pageSize}
+	)
+
+	for {
+		records, resp, err := client.Domains.Records(ctx, domainName, opt)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, records...)
+
+		if resp.Links == nil || resp.Links.IsLastPage() {
+			break
+		}
+
+		page, err := resp.Links.CurrentPage()
+		if err != nil {
+			return nil, err
+		}
+		opt.Page = page + 1
+	}
+
+	return all, nil
+}
+
+// ipProvider is one way of discovering our external IP address.
+type ipProvider struct {
+	name   string
+	lookup func(version int) (net.IP, error)
+}
+
+// GetExternalIP gets our external IP address of the given family (4 or 6),
+// trying each configured provider in order and falling through to the next
+// on failure. It only returns an error once every provider has failed.
+func GetExternalIP(version int, config Config) (net.IP, error) {
+	var lastErr error
+	for _, provider := range ipProviders(version, config) {
+		ip, err := provider.lookup(version)
+		if err != nil {
+			logWarningf("%s: could not look up our IPv%d address: %s", provider.name, version, err)
+			lastErr = err
+			continue
+		}
+
+		if version == 4 && ip.To4() == nil {
+			logWarningf("%s: returned %s, which isn't an IPv4 address", provider.name, ip)
+			continue
+		}
+		// An IPv4-mapped address from a provider that doesn't actually
+		// support IPv6 would otherwise get written straight to a AAAA
+		// record; only let it through if the user opted into that via
+		// AllowIPv4InIPv6.
+		if version == 6 && ip.To4() != nil && !config.AllowIPv4InIPv6 {
+			logWarningf("%s: returned %s, which looks like an IPv4-mapped address, not real IPv6", provider.name, ip)
+			continue
+		}
+
+		return ip, nil
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no provider returned a valid IPv%d address", version)
+	}
+	return nil, lastErr
+}
+
+// ipProviders returns the ordered list of providers to try for the given IP
+// family: the configured (or default) HTTP check URLs, followed by the
+// DNS-based resolvers as a last resort.
+func ipProviders(version int, config Config) []ipProvider {
+	urls := config.IPv4CheckURLs
+	if version == 6 {
+		urls = config.IPv6CheckURLs
+	}
+	if len(urls) == 0 {
+		urls = defaultCheckURLs(version)
+	}
+
+	providers := make([]ipProvider, 0, len(urls)+2)
+	for _, url := range urls {
+		url := url
+		providers = append(providers, ipProvider{
+			name:   url,
+			lookup: func(version int) (net.IP, error) { return httpIPLookup(url) },
+		})
+	}
+
+	providers = append(providers,
+		ipProvider{name: "resolver1.opendns.com", lookup: openDNSLookup},
+		ipProvider{name: "google-dns", lookup: googleDNSLookup},
+	)
+
+	return providers
+}
+
+// defaultCheckURLs is used when Config.IPv4CheckURLs/IPv6CheckURLs aren't set.
+func defaultCheckURLs(version int) []string {
+	if version == 6 {
+		return []string{
+			"https://api6.ipify.org",
+			"https://ipv6.icanhazip.com",
+			"https://ipv6.myexternalip.com/raw",
+		}
+	}
+	return []string{
+		"https://api.ipify.org",
+		"https://ipv4.icanhazip.com",
+		"https://ipv4.myexternalip.com/raw",
+	}
+}
 
+// httpIPLookup fetches an external IP address from an HTTP endpoint that
+// responds with the plain-text address.
+func httpIPLookup(url string) (net.IP, error) {
 	resp, err := http.Get(url)
 	if err != nil {
-		return
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return
+		return nil, err
 	}
 
 	content := strings.TrimSpace(string(body))
-	result = net.ParseIP(content)
+	ip := net.ParseIP(content)
+	if ip == nil {
+		return nil, fmt.Errorf("could not parse IP address from response: %q", content)
+	}
 
-	return
+	return ip, nil
+}
+
+// dnsLookupTimeout bounds how long the DNS-based IP providers will wait for
+// a response from their resolver.
+const dnsLookupTimeout = 5 * time.Second
+
+// dnsResolverAt returns a Resolver that queries the given "host:port"
+// nameserver directly, instead of the system's configured resolver.
+func dnsResolverAt(server string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialer := net.Dialer{Timeout: dnsLookupTimeout}
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// openDNSLookup discovers our external IP using OpenDNS's "what's my IP"
+// trick: querying myip.opendns.com against resolver1.opendns.com returns
+// the address of whoever asked. resolver1.opendns.com only answers over
+// IPv4, so this provider is an IPv4-only fallback; it errors immediately
+// for IPv6.
+func openDNSLookup(version int) (net.IP, error) {
+	if version != 4 {
+		return nil, fmt.Errorf("opendns: resolver1.opendns.com only supports IPv4 lookups")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+
+	ips, err := dnsResolverAt("resolver1.opendns.com:53").LookupIP(ctx, "ip4", "myip.opendns.com")
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("opendns: no address returned")
+	}
+
+	return ips[0], nil
+}
+
+// googleDNSLookup discovers our external IP using Google's equivalent of
+// the OpenDNS trick: a TXT query for o-o.myaddr.l.google.com. This has to
+// go straight to Google's authoritative nameserver (ns1.google.com) rather
+// than a recursive resolver like 8.8.8.8 — a recursive resolver would hand
+// the query off on our behalf, so the authoritative server would see the
+// resolver's address instead of ours.
+func googleDNSLookup(version int) (net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+
+	txts, err := dnsResolverAt("ns1.google.com:53").LookupTXT(ctx, "o-o.myaddr.l.google.com")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, txt := range txts {
+		ip := net.ParseIP(strings.Trim(txt, `"`))
+		if ip == nil {
+			continue
+		}
+		if (version == 4) == (ip.To4() != nil) {
+			return ip, nil
+		}
+	}
+
+	return nil, fmt.Errorf("google dns: no IPv%d address returned", version)
 }
 
 // Setup asks for the configuration properties.
@@ -263,15 +689,25 @@ func Setup() {
 		ttl = 1800
 	}
 
-	config := Config{
-		AccessToken: accessToken,
-		Domain:      domain,
-		TTL:         ttl,
-		RecordTypes: RecordTypes{
-			A:    ipv4,
-			AAAA: ipv6,
-		},
+	var records []RecordSpec
+	for _, name := range []string{"@", "*"} {
+		if ipv4 {
+			records = append(records, RecordSpec{Name: name, Type: "A", TTL: ttl})
+		}
+		if ipv6 {
+			records = append(records, RecordSpec{Name: name, Type: "AAAA", TTL: ttl})
+		}
 	}
+
+	// Load any existing config so this domain is appended alongside ones
+	// already configured, rather than replacing them.
+	config, _ := LoadConfig()
+	config.AccessToken = accessToken
+	config.Domains = append(config.Domains, DomainConfig{
+		Domain:  domain,
+		Records: records,
+	})
+
 	WriteConfig(config)
 }
 
@@ -332,9 +768,38 @@ func LoadConfig() (config Config, err error) {
 
 	decoder := json.NewDecoder(fh)
 	decoder.Decode(&config)
+	migrateLegacyConfig(&config)
 	return config, nil
 }
 
+// migrateLegacyConfig converts a config file written by an older version of
+// this program (one Domain, @ and * records only) into the current
+// Domains-based schema, so old config files keep working after an upgrade.
+func migrateLegacyConfig(config *Config) {
+	if len(config.Domains) > 0 || config.Domain == "" {
+		return
+	}
+
+	var records []RecordSpec
+	for _, name := range []string{"@", "*"} {
+		if config.RecordTypes.A {
+			records = append(records, RecordSpec{Name: name, Type: "A", TTL: config.TTL})
+		}
+		if config.RecordTypes.AAAA {
+			records = append(records, RecordSpec{Name: name, Type: "AAAA", TTL: config.TTL})
+		}
+	}
+
+	config.Domains = append(config.Domains, DomainConfig{
+		Domain:  config.Domain,
+		Records: records,
+	})
+
+	config.Domain = ""
+	config.TTL = 0
+	config.RecordTypes = RecordTypes{}
+}
+
 // WriteConfig saves the config to disk.
 func WriteConfig(config Config) error {
 	configFile := configdir.LocalConfig("do-dyn-dns.json")